@@ -0,0 +1,69 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package v1alpha1 contains API Schema definitions for the tensile.virtual-kubelet.io v1alpha1 API group.
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// MutationPolicy lets a cluster admin declaratively reconfigure how the
+// webhook mutates matching pods, instead of via the process-wide
+// ignoreSelectorKeys flag.
+type MutationPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MutationPolicySpec `json:"spec"`
+}
+
+// MutationPolicySpec is the desired state of a MutationPolicy.
+type MutationPolicySpec struct {
+	// NamespaceSelector restricts which namespaces this policy applies to.
+	// A nil selector matches every namespace.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Selector restricts which pods this policy applies to, matched against
+	// pod labels. A nil selector matches every pod.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// Priority breaks ties when multiple policies match the same pod; the
+	// highest priority wins.
+	Priority int32 `json:"priority,omitempty"`
+	// IgnoreSelectorKeys lists the nodeSelector/affinity label keys to
+	// preserve on the real-cluster pod instead of stripping into the
+	// sub-cluster selector annotation.
+	IgnoreSelectorKeys []string `json:"ignoreSelectorKeys,omitempty"`
+	// StripAffinityKeys lists affinity term keys to drop entirely rather
+	// than forwarding to the sub-cluster.
+	StripAffinityKeys []string `json:"stripAffinityKeys,omitempty"`
+	// ExtraTolerations are appended to the pod's tolerations at admission time.
+	ExtraTolerations []corev1.Toleration `json:"extraTolerations,omitempty"`
+	// Skip, when true, leaves matching pods untouched by the mutating webhook.
+	Skip bool `json:"skip,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// MutationPolicyList is a list of MutationPolicy.
+type MutationPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []MutationPolicy `json:"items"`
+}
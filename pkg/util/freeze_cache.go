@@ -0,0 +1,196 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFreezeCacheCapacity bounds the number of (owner, node) pairs
+	// freezeCache tracks at once; the LRU evicts the oldest entries past it.
+	defaultFreezeCacheCapacity = 10000
+	// defaultFreezeCacheTTL bounds how long an entry survives without being
+	// refreshed or explicitly forgotten.
+	defaultFreezeCacheTTL = 10 * time.Minute
+)
+
+type freezeCacheKey struct {
+	ownerRef string
+	node     string
+}
+
+type freezeCacheEntry struct {
+	key       freezeCacheKey
+	expiresAt time.Time
+}
+
+// UnschedulableCache tracks, per owner (Deployment/ReplicaSet UID), which
+// nodes should be excluded from scheduling because a previous pod on that
+// owner reported the node unschedulable. It is an LRU bounded by capacity
+// with a per-entry TTL, so a long-lived owner can't monotonically grow the
+// exclusion list forever; entries are also dropped early once the node
+// recovers or the owner is gone, via Forget and the Reconciler.
+type UnschedulableCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // front = most recently used
+	elements map[freezeCacheKey]*list.Element
+}
+
+// NewUnschedulableCache builds an UnschedulableCache with sane defaults.
+func NewUnschedulableCache() *UnschedulableCache {
+	return NewUnschedulableCacheWithOptions(defaultFreezeCacheCapacity, defaultFreezeCacheTTL)
+}
+
+// NewUnschedulableCacheWithOptions builds an UnschedulableCache with an
+// explicit capacity and per-entry TTL.
+func NewUnschedulableCacheWithOptions(capacity int, ttl time.Duration) *UnschedulableCache {
+	return &UnschedulableCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		elements: make(map[freezeCacheKey]*list.Element),
+	}
+}
+
+// Add records that node should be excluded from scheduling for ownerRef,
+// refreshing both its TTL and its LRU recency.
+func (c *UnschedulableCache) Add(node, ownerRef string) {
+	if len(node) == 0 || len(ownerRef) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := freezeCacheKey{ownerRef: ownerRef, node: node}
+	if elem, found := c.elements[key]; found {
+		elem.Value.(*freezeCacheEntry).expiresAt = time.Now().Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+	elem := c.order.PushFront(&freezeCacheEntry{key: key, expiresAt: time.Now().Add(c.ttl)})
+	c.elements[key] = elem
+	c.evictOverCapacityLocked()
+}
+
+// Forget removes a single (ownerRef, node) exclusion, e.g. once the pod's
+// unschedulable-node annotation has been cleared.
+func (c *UnschedulableCache) Forget(ownerRef, node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(freezeCacheKey{ownerRef: ownerRef, node: node})
+}
+
+// GetFreezeNodes returns the still-live (non-expired) nodes excluded for ownerRef.
+func (c *UnschedulableCache) GetFreezeNodes(ownerRef string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var nodes []string
+	for key, elem := range c.elements {
+		if key.ownerRef != ownerRef {
+			continue
+		}
+		entry := elem.Value.(*freezeCacheEntry)
+		if now.After(entry.expiresAt) {
+			continue
+		}
+		nodes = append(nodes, key.node)
+	}
+	return nodes
+}
+
+// Snapshot returns the current, still-live freeze set grouped by owner, for
+// the debug endpoint and for tests.
+func (c *UnschedulableCache) Snapshot() map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	out := make(map[string][]string)
+	for key, elem := range c.elements {
+		entry := elem.Value.(*freezeCacheEntry)
+		if now.After(entry.expiresAt) {
+			continue
+		}
+		out[key.ownerRef] = append(out[key.ownerRef], key.node)
+	}
+	return out
+}
+
+// Len reports the number of entries currently tracked, expired or not.
+func (c *UnschedulableCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// ReapExpired drops entries whose TTL has passed; called periodically by the
+// reconciler so expired entries don't linger in Len()/Snapshot() until they
+// are next looked up.
+func (c *UnschedulableCache) ReapExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for elem := c.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*freezeCacheEntry).expiresAt) {
+			c.removeElementLocked(elem)
+		}
+		elem = prev
+	}
+}
+
+func (c *UnschedulableCache) evictOverCapacityLocked() {
+	for c.order.Len() > c.capacity {
+		c.removeElementLocked(c.order.Back())
+	}
+}
+
+func (c *UnschedulableCache) removeLocked(key freezeCacheKey) {
+	if elem, found := c.elements[key]; found {
+		c.removeElementLocked(elem)
+	}
+}
+
+func (c *UnschedulableCache) removeElementLocked(elem *list.Element) {
+	if elem == nil {
+		return
+	}
+	entry := elem.Value.(*freezeCacheEntry)
+	delete(c.elements, entry.key)
+	c.order.Remove(elem)
+}
+
+// DebugHandler serves the current freeze set as JSON, for operators tracing
+// scheduling decisions without scraping metrics.
+func (c *UnschedulableCache) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.Snapshot()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
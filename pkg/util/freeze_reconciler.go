@@ -0,0 +1,109 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
+)
+
+// defaultReconcileInterval is how often the reconciler sweeps the freeze
+// cache looking for entries it can drop early.
+const defaultReconcileInterval = 30 * time.Second
+
+// OwnerExistsFunc reports whether the workload identified by ownerRef (the
+// UID stashed by getOwnerRef) still exists; used to forget freeze entries
+// for owners that have since been deleted.
+type OwnerExistsFunc func(ownerRef string) (bool, error)
+
+// FreezeCacheReconciler periodically drops UnschedulableCache entries once
+// the node they reference becomes Ready again or the owning workload no
+// longer exists, so stale exclusions can't accumulate and eventually make
+// every pod of a long-lived Deployment unschedulable.
+type FreezeCacheReconciler struct {
+	cache       *UnschedulableCache
+	nodeLister  corelisters.NodeLister
+	ownerExists OwnerExistsFunc
+	interval    time.Duration
+}
+
+// NewFreezeCacheReconciler builds a FreezeCacheReconciler. ownerExists may be
+// nil, in which case entries are only dropped once their node is Ready again
+// or no longer exists, or their TTL expires.
+func NewFreezeCacheReconciler(cache *UnschedulableCache, nodeLister corelisters.NodeLister, ownerExists OwnerExistsFunc) *FreezeCacheReconciler {
+	return &FreezeCacheReconciler{
+		cache:       cache,
+		nodeLister:  nodeLister,
+		ownerExists: ownerExists,
+		interval:    defaultReconcileInterval,
+	}
+}
+
+// Run blocks, sweeping the cache on interval until stopCh is closed.
+func (r *FreezeCacheReconciler) Run(stopCh <-chan struct{}) {
+	wait.Until(r.reconcileOnce, r.interval, stopCh)
+}
+
+func (r *FreezeCacheReconciler) reconcileOnce() {
+	r.cache.ReapExpired()
+	for ownerRef, nodes := range r.cache.Snapshot() {
+		if r.ownerExists != nil {
+			exists, err := r.ownerExists(ownerRef)
+			if err != nil {
+				klog.Errorf("FreezeCacheReconciler: check owner %v existence: %v", ownerRef, err)
+			} else if !exists {
+				for _, node := range nodes {
+					klog.V(4).Infof("FreezeCacheReconciler: owner %v gone, forgetting node %v", ownerRef, node)
+					r.cache.Forget(ownerRef, node)
+				}
+				continue
+			}
+		}
+		for _, node := range nodes {
+			ready, err := r.nodeReady(node)
+			if err != nil {
+				continue
+			}
+			if ready {
+				klog.V(4).Infof("FreezeCacheReconciler: node %v ready again, forgetting owner %v", node, ownerRef)
+				r.cache.Forget(ownerRef, node)
+			}
+		}
+	}
+}
+
+func (r *FreezeCacheReconciler) nodeReady(name string) (bool, error) {
+	node, err := r.nodeLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		// Node is gone entirely; nothing left to exclude it for.
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
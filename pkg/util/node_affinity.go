@@ -0,0 +1,113 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// NodeMatchesAffinity reports whether node satisfies affinity's
+// RequiredDuringSchedulingIgnoredDuringExecution node selector (the OR of its
+// NodeSelectorTerms, each the AND of its MatchExpressions/MatchFields). A nil
+// affinity or nil NodeAffinity matches everything, mirroring the scheduler's
+// own interpretation of an absent selector.
+func NodeMatchesAffinity(node *corev1.Node, affinity *corev1.Affinity) bool {
+	if affinity == nil || affinity.NodeAffinity == nil {
+		return true
+	}
+	required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		return true
+	}
+	for _, term := range required.NodeSelectorTerms {
+		if nodeMatchesTerm(node, term) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeMatchesTerm(node *corev1.Node, term corev1.NodeSelectorTerm) bool {
+	for _, expr := range term.MatchExpressions {
+		if !matchNodeSelectorRequirement(expr, node.Labels[expr.Key], node.Labels) {
+			return false
+		}
+	}
+	for _, field := range term.MatchFields {
+		if field.Key != "metadata.name" {
+			continue
+		}
+		if !matchNodeSelectorRequirement(field, node.Name, map[string]string{"metadata.name": node.Name}) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchNodeSelectorRequirement(req corev1.NodeSelectorRequirement, value string, values map[string]string) bool {
+	_, has := values[req.Key]
+	switch req.Operator {
+	case corev1.NodeSelectorOpExists:
+		return has
+	case corev1.NodeSelectorOpDoesNotExist:
+		return !has
+	case corev1.NodeSelectorOpIn:
+		if !has {
+			return false
+		}
+		for _, v := range req.Values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	case corev1.NodeSelectorOpNotIn:
+		if !has {
+			return true
+		}
+		for _, v := range req.Values {
+			if v == value {
+				return false
+			}
+		}
+		return true
+	case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+		if !has || len(req.Values) != 1 {
+			return false
+		}
+		nodeNum, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		reqNum, err := strconv.ParseInt(req.Values[0], 10, 64)
+		if err != nil {
+			return false
+		}
+		if req.Operator == corev1.NodeSelectorOpGt {
+			return nodeNum > reqNum
+		}
+		return nodeNum < reqNum
+	default:
+		// An operator this admission-time approximation doesn't know about
+		// is treated as "skip this requirement" rather than "never matches",
+		// so an unrecognized future operator can't cause a false rejection
+		// for a scheduling feature the real scheduler does support.
+		return true
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// injectAffinity splits a pod's affinity in two along ignoreLabels: kept
+// holds everything the real cluster should keep enforcing on the pod itself,
+// and stripped holds everything that should instead travel to the
+// sub-cluster inside util.SelectorKey. A requirement/term is kept if its
+// label key is in ignoreLabels, stripped otherwise; both sides are built
+// functionally (no in-place slice splicing) so there's no risk of the
+// caller's Affinity being left half-mutated. Either return value is nil if
+// nothing ended up on that side.
+func injectAffinity(affinity *corev1.Affinity, ignoreLabels []string) (kept, stripped *corev1.Affinity) {
+	if affinity == nil {
+		return nil, nil
+	}
+	labelMap := make(map[string]bool, len(ignoreLabels))
+	for _, v := range ignoreLabels {
+		labelMap[v] = true
+	}
+
+	keptNA, strippedNA := splitNodeAffinity(affinity.NodeAffinity, labelMap)
+	keptPA, strippedPA := splitPodAffinityTerms(affinity.PodAffinity, labelMap)
+	keptPAA, strippedPAA := splitPodAntiAffinityTerms(affinity.PodAntiAffinity, labelMap)
+
+	kept = affinityOrNil(keptNA, keptPA, keptPAA)
+	stripped = affinityOrNil(strippedNA, strippedPA, strippedPAA)
+	return kept, stripped
+}
+
+func affinityOrNil(na *corev1.NodeAffinity, pa *corev1.PodAffinity, paa *corev1.PodAntiAffinity) *corev1.Affinity {
+	if na == nil && pa == nil && paa == nil {
+		return nil
+	}
+	return &corev1.Affinity{NodeAffinity: na, PodAffinity: pa, PodAntiAffinity: paa}
+}
+
+func splitNodeAffinity(na *corev1.NodeAffinity, labelMap map[string]bool) (kept, stripped *corev1.NodeAffinity) {
+	if na == nil {
+		return nil, nil
+	}
+	keptRequired, strippedRequired := splitNodeSelector(na.RequiredDuringSchedulingIgnoredDuringExecution, labelMap)
+
+	var keptPreferred, strippedPreferred []corev1.PreferredSchedulingTerm
+	for _, pref := range na.PreferredDuringSchedulingIgnoredDuringExecution {
+		keptTerm, strippedTerm := splitNodeSelectorTerm(pref.Preference, labelMap)
+		if keptTerm != nil {
+			keptPreferred = append(keptPreferred, corev1.PreferredSchedulingTerm{Weight: pref.Weight, Preference: *keptTerm})
+		}
+		if strippedTerm != nil {
+			strippedPreferred = append(strippedPreferred, corev1.PreferredSchedulingTerm{Weight: pref.Weight, Preference: *strippedTerm})
+		}
+	}
+
+	if keptRequired != nil || len(keptPreferred) != 0 {
+		kept = &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  keptRequired,
+			PreferredDuringSchedulingIgnoredDuringExecution: keptPreferred,
+		}
+	}
+	if strippedRequired != nil || len(strippedPreferred) != 0 {
+		stripped = &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  strippedRequired,
+			PreferredDuringSchedulingIgnoredDuringExecution: strippedPreferred,
+		}
+	}
+	return kept, stripped
+}
+
+func splitNodeSelector(sel *corev1.NodeSelector, labelMap map[string]bool) (kept, stripped *corev1.NodeSelector) {
+	if sel == nil {
+		return nil, nil
+	}
+	var keptTerms, strippedTerms []corev1.NodeSelectorTerm
+	for _, term := range sel.NodeSelectorTerms {
+		keptTerm, strippedTerm := splitNodeSelectorTerm(term, labelMap)
+		if keptTerm != nil {
+			keptTerms = append(keptTerms, *keptTerm)
+		}
+		if strippedTerm != nil {
+			strippedTerms = append(strippedTerms, *strippedTerm)
+		}
+	}
+	if len(keptTerms) != 0 {
+		kept = &corev1.NodeSelector{NodeSelectorTerms: keptTerms}
+	}
+	if len(strippedTerms) != 0 {
+		stripped = &corev1.NodeSelector{NodeSelectorTerms: strippedTerms}
+	}
+	return kept, stripped
+}
+
+// splitNodeSelectorTerm partitions a single term's requirements by key,
+// returning nil for a side that ends up with no MatchExpressions/MatchFields
+// at all (an empty NodeSelectorTerm matches every node, so dropping it
+// entirely is the only safe behavior for an OR'd term list).
+func splitNodeSelectorTerm(term corev1.NodeSelectorTerm, labelMap map[string]bool) (kept, stripped *corev1.NodeSelectorTerm) {
+	keptME, strippedME := splitNodeSelectorRequirements(term.MatchExpressions, labelMap)
+	keptMF, strippedMF := splitNodeSelectorRequirements(term.MatchFields, labelMap)
+	if len(keptME) != 0 || len(keptMF) != 0 {
+		kept = &corev1.NodeSelectorTerm{MatchExpressions: keptME, MatchFields: keptMF}
+	}
+	if len(strippedME) != 0 || len(strippedMF) != 0 {
+		stripped = &corev1.NodeSelectorTerm{MatchExpressions: strippedME, MatchFields: strippedMF}
+	}
+	return kept, stripped
+}
+
+func splitNodeSelectorRequirements(reqs []corev1.NodeSelectorRequirement, labelMap map[string]bool) (kept, stripped []corev1.NodeSelectorRequirement) {
+	for _, req := range reqs {
+		if labelMap[req.Key] {
+			kept = append(kept, *req.DeepCopy())
+			continue
+		}
+		stripped = append(stripped, *req.DeepCopy())
+	}
+	return kept, stripped
+}
+
+func splitPodAffinityTerms(pa *corev1.PodAffinity, labelMap map[string]bool) (kept, stripped *corev1.PodAffinity) {
+	if pa == nil {
+		return nil, nil
+	}
+	keptRequired, strippedRequired := splitPodAffinityTermSlice(pa.RequiredDuringSchedulingIgnoredDuringExecution, labelMap)
+	keptPreferred, strippedPreferred := splitWeightedPodAffinityTerms(pa.PreferredDuringSchedulingIgnoredDuringExecution, labelMap)
+	if len(keptRequired) != 0 || len(keptPreferred) != 0 {
+		kept = &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  keptRequired,
+			PreferredDuringSchedulingIgnoredDuringExecution: keptPreferred,
+		}
+	}
+	if len(strippedRequired) != 0 || len(strippedPreferred) != 0 {
+		stripped = &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  strippedRequired,
+			PreferredDuringSchedulingIgnoredDuringExecution: strippedPreferred,
+		}
+	}
+	return kept, stripped
+}
+
+func splitPodAntiAffinityTerms(paa *corev1.PodAntiAffinity, labelMap map[string]bool) (kept, stripped *corev1.PodAntiAffinity) {
+	if paa == nil {
+		return nil, nil
+	}
+	keptRequired, strippedRequired := splitPodAffinityTermSlice(paa.RequiredDuringSchedulingIgnoredDuringExecution, labelMap)
+	keptPreferred, strippedPreferred := splitWeightedPodAffinityTerms(paa.PreferredDuringSchedulingIgnoredDuringExecution, labelMap)
+	if len(keptRequired) != 0 || len(keptPreferred) != 0 {
+		kept = &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  keptRequired,
+			PreferredDuringSchedulingIgnoredDuringExecution: keptPreferred,
+		}
+	}
+	if len(strippedRequired) != 0 || len(strippedPreferred) != 0 {
+		stripped = &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  strippedRequired,
+			PreferredDuringSchedulingIgnoredDuringExecution: strippedPreferred,
+		}
+	}
+	return kept, stripped
+}
+
+func splitWeightedPodAffinityTerms(terms []corev1.WeightedPodAffinityTerm, labelMap map[string]bool) (kept, stripped []corev1.WeightedPodAffinityTerm) {
+	for _, w := range terms {
+		keptTerm, strippedTerm := splitPodAffinityTerm(w.PodAffinityTerm, labelMap)
+		if keptTerm != nil {
+			kept = append(kept, corev1.WeightedPodAffinityTerm{Weight: w.Weight, PodAffinityTerm: *keptTerm})
+		}
+		if strippedTerm != nil {
+			stripped = append(stripped, corev1.WeightedPodAffinityTerm{Weight: w.Weight, PodAffinityTerm: *strippedTerm})
+		}
+	}
+	return kept, stripped
+}
+
+func splitPodAffinityTermSlice(terms []corev1.PodAffinityTerm, labelMap map[string]bool) (kept, stripped []corev1.PodAffinityTerm) {
+	for _, term := range terms {
+		keptTerm, strippedTerm := splitPodAffinityTerm(term, labelMap)
+		if keptTerm != nil {
+			kept = append(kept, *keptTerm)
+		}
+		if strippedTerm != nil {
+			stripped = append(stripped, *strippedTerm)
+		}
+	}
+	return kept, stripped
+}
+
+// splitPodAffinityTerm partitions a PodAffinityTerm's LabelSelector by key,
+// keeping Namespaces/NamespaceSelector/TopologyKey identical on both sides
+// since those aren't label keys to split on. Returns nil for a side whose
+// LabelSelector ends up matching nothing (no MatchLabels/MatchExpressions left).
+func splitPodAffinityTerm(term corev1.PodAffinityTerm, labelMap map[string]bool) (kept, stripped *corev1.PodAffinityTerm) {
+	keptSel, strippedSel := splitLabelSelector(term.LabelSelector, labelMap)
+	if keptSel != nil {
+		t := term
+		t.LabelSelector = keptSel
+		kept = &t
+	}
+	if strippedSel != nil {
+		t := term
+		t.LabelSelector = strippedSel
+		stripped = &t
+	}
+	return kept, stripped
+}
+
+func splitLabelSelector(sel *metav1.LabelSelector, labelMap map[string]bool) (kept, stripped *metav1.LabelSelector) {
+	if sel == nil {
+		return nil, nil
+	}
+	keptLabels, strippedLabels := splitMatchLabels(sel.MatchLabels, labelMap)
+	keptExprs, strippedExprs := splitLabelSelectorRequirements(sel.MatchExpressions, labelMap)
+	if len(keptLabels) != 0 || len(keptExprs) != 0 {
+		kept = &metav1.LabelSelector{MatchLabels: keptLabels, MatchExpressions: keptExprs}
+	}
+	if len(strippedLabels) != 0 || len(strippedExprs) != 0 {
+		stripped = &metav1.LabelSelector{MatchLabels: strippedLabels, MatchExpressions: strippedExprs}
+	}
+	return kept, stripped
+}
+
+func splitMatchLabels(matchLabels map[string]string, labelMap map[string]bool) (kept, stripped map[string]string) {
+	for k, v := range matchLabels {
+		if labelMap[k] {
+			if kept == nil {
+				kept = make(map[string]string)
+			}
+			kept[k] = v
+			continue
+		}
+		if stripped == nil {
+			stripped = make(map[string]string)
+		}
+		stripped[k] = v
+	}
+	return kept, stripped
+}
+
+func splitLabelSelectorRequirements(reqs []metav1.LabelSelectorRequirement, labelMap map[string]bool) (kept, stripped []metav1.LabelSelectorRequirement) {
+	for _, req := range reqs {
+		if labelMap[req.Key] {
+			kept = append(kept, *req.DeepCopy())
+			continue
+		}
+		stripped = append(stripped, *req.DeepCopy())
+	}
+	return kept, stripped
+}
+
+// dropAffinityKeys removes every requirement/term whose key is in dropKeys
+// from affinity entirely, returning what's left. It's injectAffinity's
+// kept/stripped split run with dropKeys as the label map and the "stripped"
+// (non-matching) half kept as the result, since that's exactly "everything
+// that isn't one of these keys".
+func dropAffinityKeys(affinity *corev1.Affinity, dropKeys []string) *corev1.Affinity {
+	if affinity == nil || len(dropKeys) == 0 {
+		return affinity
+	}
+	_, remaining := injectAffinity(affinity, dropKeys)
+	return remaining
+}
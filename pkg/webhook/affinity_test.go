@@ -0,0 +1,192 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func labelSelector(matchLabels map[string]string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchLabels: matchLabels}
+}
+
+func nodeSelectorTerm(meKeys, mfKeys []string) corev1.NodeSelectorTerm {
+	term := corev1.NodeSelectorTerm{}
+	for _, k := range meKeys {
+		term.MatchExpressions = append(term.MatchExpressions, corev1.NodeSelectorRequirement{
+			Key: k, Operator: corev1.NodeSelectorOpIn, Values: []string{"v"},
+		})
+	}
+	for _, k := range mfKeys {
+		term.MatchFields = append(term.MatchFields, corev1.NodeSelectorRequirement{
+			Key: k, Operator: corev1.NodeSelectorOpIn, Values: []string{"v"},
+		})
+	}
+	return term
+}
+
+func TestInjectAffinityRequiredMultiTermOR(t *testing.T) {
+	affinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					nodeSelectorTerm([]string{"zone", "region"}, nil),
+					nodeSelectorTerm([]string{"rack"}, nil),
+				},
+			},
+		},
+	}
+
+	kept, stripped := injectAffinity(affinity, []string{"zone"})
+
+	if kept == nil || kept.NodeAffinity == nil {
+		t.Fatalf("expected kept NodeAffinity, got %+v", kept)
+	}
+	keptTerms := kept.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(keptTerms) != 1 || len(keptTerms[0].MatchExpressions) != 1 || keptTerms[0].MatchExpressions[0].Key != "zone" {
+		t.Fatalf("expected kept to contain only the zone term, got %+v", keptTerms)
+	}
+
+	if stripped == nil || stripped.NodeAffinity == nil {
+		t.Fatalf("expected stripped NodeAffinity, got %+v", stripped)
+	}
+	strippedTerms := stripped.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(strippedTerms) != 2 {
+		t.Fatalf("expected two stripped terms (region, rack), got %+v", strippedTerms)
+	}
+}
+
+func TestInjectAffinityMatchFieldsAlongsideMatchExpressions(t *testing.T) {
+	affinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					nodeSelectorTerm([]string{"zone"}, []string{"metadata.name"}),
+				},
+			},
+		},
+	}
+
+	kept, stripped := injectAffinity(affinity, []string{"zone"})
+
+	if kept == nil {
+		t.Fatalf("expected kept affinity for zone match expression")
+	}
+	keptTerm := kept.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0]
+	if len(keptTerm.MatchExpressions) != 1 || len(keptTerm.MatchFields) != 0 {
+		t.Fatalf("expected only the zone match expression kept, got %+v", keptTerm)
+	}
+
+	if stripped == nil {
+		t.Fatalf("expected stripped affinity for metadata.name match field")
+	}
+	strippedTerm := stripped.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0]
+	if len(strippedTerm.MatchFields) != 1 || len(strippedTerm.MatchExpressions) != 0 {
+		t.Fatalf("expected only the metadata.name match field stripped, got %+v", strippedTerm)
+	}
+}
+
+func TestInjectAffinityEmptyAfterFilterDropsTerm(t *testing.T) {
+	affinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					nodeSelectorTerm([]string{"zone"}, nil),
+				},
+			},
+		},
+	}
+
+	// ignoreLabels keeps everything, so nothing should be left to strip.
+	kept, stripped := injectAffinity(affinity, []string{"zone"})
+	if kept == nil {
+		t.Fatalf("expected kept affinity to retain the zone term")
+	}
+	if stripped != nil {
+		t.Fatalf("expected nil stripped affinity when the term fully matches ignoreLabels, got %+v", stripped)
+	}
+
+	// ignoreLabels keeps nothing, so nothing should be left on the pod.
+	kept, stripped = injectAffinity(affinity, nil)
+	if kept != nil {
+		t.Fatalf("expected nil kept affinity when no keys are ignored, got %+v", kept)
+	}
+	if stripped == nil {
+		t.Fatalf("expected stripped affinity to retain the zone term")
+	}
+}
+
+func TestInjectAffinityPreferredWeightsPreserved(t *testing.T) {
+	affinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+				{Weight: 42, Preference: nodeSelectorTerm([]string{"zone"}, nil)},
+				{Weight: 7, Preference: nodeSelectorTerm([]string{"rack"}, nil)},
+			},
+		},
+	}
+
+	kept, stripped := injectAffinity(affinity, []string{"zone"})
+
+	if kept == nil || len(kept.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) != 1 ||
+		kept.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].Weight != 42 {
+		t.Fatalf("expected kept preferred term to keep its weight of 42, got %+v", kept)
+	}
+	if stripped == nil || len(stripped.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) != 1 ||
+		stripped.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].Weight != 7 {
+		t.Fatalf("expected stripped preferred term to keep its weight of 7, got %+v", stripped)
+	}
+}
+
+func TestInjectAffinityPodAffinityAndAntiAffinity(t *testing.T) {
+	affinity := &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{
+					TopologyKey:   "kubernetes.io/hostname",
+					LabelSelector: labelSelector(map[string]string{"app": "web", "zone": "a"}),
+				},
+			},
+		},
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{
+					TopologyKey:   "kubernetes.io/hostname",
+					LabelSelector: labelSelector(map[string]string{"app": "web"}),
+				},
+			},
+		},
+	}
+
+	kept, stripped := injectAffinity(affinity, []string{"zone"})
+
+	if kept == nil || kept.PodAffinity == nil {
+		t.Fatalf("expected kept PodAffinity for the zone label, got %+v", kept)
+	}
+	if stripped == nil || stripped.PodAffinity == nil {
+		t.Fatalf("expected stripped PodAffinity for the app label, got %+v", stripped)
+	}
+	if stripped.PodAntiAffinity == nil {
+		t.Fatalf("expected stripped PodAntiAffinity for the app label, got %+v", stripped)
+	}
+	if kept.PodAntiAffinity != nil {
+		t.Fatalf("expected nil kept PodAntiAffinity since app is not an ignored key, got %+v", kept.PodAntiAffinity)
+	}
+}
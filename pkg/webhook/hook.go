@@ -21,14 +21,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
 	v1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 
 	"github.com/virtual-kubelet/tensile-kube/pkg/util"
@@ -53,23 +59,72 @@ var (
 			Effect:   corev1.TaintEffectNoExecute,
 		},
 	}
+
+	admissionV1GVK      = admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")
+	admissionV1beta1GVK = admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview")
 )
 
 // HookServer is an interface defines a server
 type HookServer interface {
-	// Serve starts a server
+	// Serve handles a MutatingWebhookConfiguration callback
 	Serve(http.ResponseWriter, *http.Request)
+	// Validate handles a ValidatingWebhookConfiguration callback
+	Validate(http.ResponseWriter, *http.Request)
 }
 
 // webhookServer is a sever for webhook
 type webhookServer struct {
 	ignoreSelectorKeys []string
 	pvcLister          v1.PersistentVolumeClaimLister
+	policyStore        *PolicyStore
+	recorder           record.EventRecorder
+	validatePredicates []string
+	clusterNodeListers map[string]v1.NodeLister
+	maxTolerations     int
 	Server             *http.Server
 }
 
+// SetValidatingPredicates enables the named predicates (see validate.go) on
+// the ValidatingWebhookConfiguration path. Unknown names are logged and
+// skipped rather than rejected, so a typo doesn't wedge the server.
+func (whsvr *webhookServer) SetValidatingPredicates(names []string) {
+	whsvr.validatePredicates = names
+}
+
+// SetClusterNodeListers registers, by sub-cluster name, the NodeListers the
+// affinity-matches-node and pvc-node-known predicates check candidate pods
+// against.
+func (whsvr *webhookServer) SetClusterNodeListers(listers map[string]v1.NodeLister) {
+	whsvr.clusterNodeListers = listers
+}
+
+// SetMaxTolerations sets the limit the max-tolerations predicate checks;
+// zero (the default) disables the check. The predicate only runs when
+// "max-tolerations" is also named in SetValidatingPredicates.
+func (whsvr *webhookServer) SetMaxTolerations(max int) {
+	whsvr.maxTolerations = max
+}
+
+// SetEventRecorder wires an EventRecorder used to surface scheduling
+// decisions (unschedulable-node exclusions, PVC node pinning) as Kubernetes
+// Events on the mutated Pod. Optional; mutate/trySetNodeName are no-ops on
+// events if it is never set.
+func (whsvr *webhookServer) SetEventRecorder(recorder record.EventRecorder) {
+	whsvr.recorder = recorder
+}
+
+func (whsvr *webhookServer) recordEvent(pod *corev1.Pod, eventType, reason, message string) {
+	if whsvr.recorder == nil {
+		return
+	}
+	whsvr.recorder.Event(pod, eventType, reason, message)
+}
+
 func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
+	_ = admissionv1.AddToScheme(runtimeScheme)
+	_ = admissionv1beta1.AddToScheme(runtimeScheme)
+	_ = admissionregistrationv1.AddToScheme(runtimeScheme)
 	_ = admissionregistrationv1beta1.AddToScheme(runtimeScheme)
 }
 
@@ -81,55 +136,125 @@ func NewWebhookServer(pvcLister v1.PersistentVolumeClaimLister, ignoreKeys []str
 	}
 }
 
+// NewWebhookServerWithPolicies starts a new webhook server backed by a
+// MutationPolicy PolicyStore, so cluster admins can reconfigure mutation
+// per-namespace/per-label-selector without redeploying the webhook.
+// ignoreKeys applies to every pod; a matching MutationPolicy's
+// IgnoreSelectorKeys are added to it rather than replacing it.
+func NewWebhookServerWithPolicies(pvcLister v1.PersistentVolumeClaimLister, ignoreKeys []string, store *PolicyStore) HookServer {
+	return &webhookServer{
+		ignoreSelectorKeys: ignoreKeys,
+		pvcLister:          pvcLister,
+		policyStore:        store,
+	}
+}
+
+// admissionRequest is a version-agnostic view of an incoming AdmissionRequest,
+// carrying only the fields mutate() actually needs.
+type admissionRequest struct {
+	UID       types.UID
+	Kind      metav1.GroupVersionKind
+	Operation string
+	Object    runtime.RawExtension
+	OldObject runtime.RawExtension
+}
+
+// admissionResponse is a version-agnostic view of the AdmissionResponse mutate()
+// produces; buildReviewResponse re-encodes it into whichever version the
+// request came in as.
+type admissionResponse struct {
+	Allowed   bool
+	Result    *metav1.Status
+	Patch     []byte
+	PatchType *string
+}
+
 // mutate k8s pod annotations, Affinity, nodeSelector and etc.
-func (whsvr *webhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+func (whsvr *webhookServer) mutate(req *admissionRequest) (resp *admissionResponse) {
+	start := time.Now()
 	var (
 		err error
 		pod corev1.Pod
 	)
+	defer func() {
+		observeMutationDuration(req.Operation, start)
+		decision := "allowed"
+		patched := "false"
+		if resp != nil {
+			if !resp.Allowed {
+				decision = "denied"
+			}
+			if len(resp.Patch) > 0 {
+				patched = "true"
+				patchSizeBytes.Observe(float64(len(resp.Patch)))
+			}
+		}
+		admissionRequestsTotal.WithLabelValues(req.Operation, pod.Namespace, decision, patched).Inc()
+	}()
 	switch req.Kind.Kind {
 	case "Pod":
 		rawBytes := req.Object.Raw
 		klog.V(4).Infof("Raw request %v", string(rawBytes))
 		if err := json.Unmarshal(rawBytes, &pod); err != nil {
 			klog.Errorf("Could not unmarshal raw object %v err: %v", req, err)
-			return &v1beta1.AdmissionResponse{
+			decodeErrorsTotal.Inc()
+			return &admissionResponse{
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
 			}
 		}
 	default:
-		return &v1beta1.AdmissionResponse{
+		return &admissionResponse{
 			Allowed: false,
 		}
 	}
 	if shouldSkip(&pod) {
-		return &v1beta1.AdmissionResponse{
+		return &admissionResponse{
 			Allowed: true,
 		}
 	}
+	var policy *mergedMutationPolicy
+	if whsvr.policyStore != nil {
+		policy = whsvr.policyStore.PolicyFor(&pod)
+		if policy != nil && policy.Skip {
+			return &admissionResponse{
+				Allowed: true,
+			}
+		}
+	}
 	ref := getOwnerRef(&pod)
 	clone := pod.DeepCopy()
 	switch req.Operation {
-	case v1beta1.Update:
-		setUnschedulableNodes(ref, clone)
-		return &v1beta1.AdmissionResponse{
+	case "UPDATE":
+		setUnschedulableNodes(ref, clone, oldPodAnnotation(req.OldObject, "unschedulable-node"))
+		return &admissionResponse{
 			Allowed: true,
 		}
-	case v1beta1.Create:
+	case "CREATE":
 		nodes := getUnschedulableNodes(ref, clone)
+		recordFreezeCacheLookup(nodes)
 		if len(nodes) > 0 {
 			klog.Infof("Create pod %v Not nodes %+v", clone.Name, nodes)
 			clone.Spec.Affinity, _ = util.ReplacePodNodeNameNodeAffinity(clone.Spec.Affinity, ref, 0, nil, nodes...)
+			whsvr.recordEvent(clone, corev1.EventTypeNormal, "UnschedulableNodesExcluded",
+				fmt.Sprintf("Excluded unschedulable nodes %v from node affinity", nodes))
 		}
 	default:
 		klog.Warningf("Skip operation: %v", req.Operation)
 	}
 
 	whsvr.trySetNodeName(clone)
-	inject(clone, whsvr.ignoreSelectorKeys)
+	ignoreKeys := whsvr.ignoreSelectorKeys
+	var extraTolerations []corev1.Toleration
+	var stripKeys []string
+	if policy != nil {
+		ignoreKeys = append(append([]string{}, ignoreKeys...), policy.IgnoreSelectorKeys...)
+		extraTolerations = policy.ExtraTolerations
+		stripKeys = policy.StripAffinityKeys
+	}
+	inject(clone, ignoreKeys, stripKeys)
+	clone.Spec.Tolerations = append(clone.Spec.Tolerations, extraTolerations...)
 	patch, err := util.CreateJSONPatch(pod, clone)
 	klog.Infof("Final patch %+v", string(patch))
 	var result metav1.Status
@@ -137,8 +262,8 @@ func (whsvr *webhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 		result.Code = 403
 		result.Message = err.Error()
 	}
-	jsonPatch := v1beta1.PatchTypeJSONPatch
-	return &v1beta1.AdmissionResponse{
+	jsonPatch := string(admissionv1.PatchTypeJSONPatch)
+	return &admissionResponse{
 		Allowed:   true,
 		Result:    &result,
 		Patch:     patch,
@@ -146,20 +271,44 @@ func (whsvr *webhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 	}
 }
 
-// Serve method for webhook server
+// Serve method for webhook server. It accepts both the admission.k8s.io/v1
+// and the deprecated admission.k8s.io/v1beta1 AdmissionReview payloads,
+// decoding whichever the apiserver sent and re-encoding the response in the
+// same version so older apiservers keep working during a rolling upgrade.
 func (whsvr *webhookServer) Serve(w http.ResponseWriter, r *http.Request) {
-	admissionReview, err := getRequestReview(r)
+	whsvr.serveReview(w, r, whsvr.mutate)
+}
+
+// Validate serves a ValidatingWebhookConfiguration callback, running the
+// enabled predicates (see validate.go) against the candidate pod instead of
+// mutating it.
+func (whsvr *webhookServer) Validate(w http.ResponseWriter, r *http.Request) {
+	whsvr.serveReview(w, r, whsvr.validate)
+}
+
+func (whsvr *webhookServer) serveReview(w http.ResponseWriter, r *http.Request, handle func(*admissionRequest) *admissionResponse) {
+	body, err := readRequestBody(r)
 	if err != nil {
 		klog.Error(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	admissionResponse := whsvr.mutate(admissionReview)
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		admissionReview.Response.UID = admissionReview.Request.UID
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		klog.Errorf("Can't decode body: %v", err)
+		http.Error(w, fmt.Sprintf("could not decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req, err := toAdmissionRequest(obj, gvk)
+	if err != nil {
+		klog.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	resp, err := json.Marshal(admissionReview)
+
+	admissionResp := handle(req)
+	resp, err := buildReviewResponse(gvk, req.UID, admissionResp)
 	if err != nil {
 		klog.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
@@ -171,6 +320,93 @@ func (whsvr *webhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, fmt.Errorf("empty body")
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(5).Infof("Receive request: %+v", *r)
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty body")
+	}
+	return body, nil
+}
+
+// toAdmissionRequest extracts the common fields mutate() needs out of either
+// an admission/v1 or an admission/v1beta1 AdmissionReview.
+func toAdmissionRequest(obj runtime.Object, gvk *schema.GroupVersionKind) (*admissionRequest, error) {
+	switch *gvk {
+	case admissionV1GVK:
+		ar, ok := obj.(*admissionv1.AdmissionReview)
+		if !ok || ar.Request == nil {
+			return nil, fmt.Errorf("malformed admission.k8s.io/v1 AdmissionReview")
+		}
+		return &admissionRequest{
+			UID:       ar.Request.UID,
+			Kind:      ar.Request.Kind,
+			Operation: string(ar.Request.Operation),
+			Object:    ar.Request.Object,
+			OldObject: ar.Request.OldObject,
+		}, nil
+	case admissionV1beta1GVK:
+		ar, ok := obj.(*admissionv1beta1.AdmissionReview)
+		if !ok || ar.Request == nil {
+			return nil, fmt.Errorf("malformed admission.k8s.io/v1beta1 AdmissionReview")
+		}
+		return &admissionRequest{
+			UID:       ar.Request.UID,
+			Kind:      ar.Request.Kind,
+			Operation: string(ar.Request.Operation),
+			Object:    ar.Request.Object,
+			OldObject: ar.Request.OldObject,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported AdmissionReview version %v", gvk)
+	}
+}
+
+// buildReviewResponse re-encodes an admissionResponse as an AdmissionReview in
+// the same version the incoming request used.
+func buildReviewResponse(gvk *schema.GroupVersionKind, uid types.UID, resp *admissionResponse) ([]byte, error) {
+	switch *gvk {
+	case admissionV1GVK:
+		ar := &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+			Response: &admissionv1.AdmissionResponse{
+				UID:     uid,
+				Allowed: resp.Allowed,
+				Result:  resp.Result,
+				Patch:   resp.Patch,
+			},
+		}
+		if resp.PatchType != nil {
+			pt := admissionv1.PatchType(*resp.PatchType)
+			ar.Response.PatchType = &pt
+		}
+		return json.Marshal(ar)
+	case admissionV1beta1GVK:
+		ar := &admissionv1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: admissionv1beta1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+			Response: &admissionv1beta1.AdmissionResponse{
+				UID:     uid,
+				Allowed: resp.Allowed,
+				Result:  resp.Result,
+				Patch:   resp.Patch,
+			},
+		}
+		if resp.PatchType != nil {
+			pt := admissionv1beta1.PatchType(*resp.PatchType)
+			ar.Response.PatchType = &pt
+		}
+		return json.Marshal(ar)
+	default:
+		return nil, fmt.Errorf("unsupported AdmissionReview version %v", gvk)
+	}
+}
+
 func (whsvr *webhookServer) trySetNodeName(pod *corev1.Pod) {
 	if pod.Spec.Volumes == nil {
 		return
@@ -185,6 +421,8 @@ func (whsvr *webhookServer) trySetNodeName(pod *corev1.Pod) {
 		if len(nodeName) != 0 {
 			pod.Spec.NodeName = nodeName
 			klog.Infof("Set desired node name to %v ", nodeName)
+			whsvr.recordEvent(pod, corev1.EventTypeNormal, "PinnedToPVCNode",
+				fmt.Sprintf("Pinned pod to node %v selected by PVC %v", nodeName, pvcSource.ClaimName))
 			return
 		}
 	}
@@ -203,7 +441,11 @@ func (whsvr *webhookServer) getNodeNameFromPVC(ns, pvcName string) string {
 	return pvc.Annotations[util.SelectedNodeKey]
 }
 
-func inject(pod *corev1.Pod, ignoreKeys []string) {
+// inject splits pod's NodeSelector/Affinity into what stays on the real pod
+// (ignoreKeys) and what moves into the sub-cluster selection annotation,
+// then drops any key listed in stripKeys from both affinity halves entirely.
+// stripKeys applies to affinity only; NodeSelector entries are not stripped.
+func inject(pod *corev1.Pod, ignoreKeys, stripKeys []string) {
 	nodeSelector := make(map[string]string)
 	var affinity *corev1.Affinity
 
@@ -212,7 +454,13 @@ func inject(pod *corev1.Pod, ignoreKeys []string) {
 	}
 
 	if pod.Spec.Affinity != nil {
-		affinity = injectAffinity(pod.Spec.Affinity, ignoreKeys)
+		kept, stripped := injectAffinity(pod.Spec.Affinity, ignoreKeys)
+		if len(stripKeys) > 0 {
+			kept = dropAffinityKeys(kept, stripKeys)
+			stripped = dropAffinityKeys(stripped, stripKeys)
+		}
+		pod.Spec.Affinity = kept
+		affinity = stripped
 	}
 
 	if pod.Spec.NodeSelector != nil {
@@ -288,79 +536,6 @@ func injectNodeSelector(nodeSelector map[string]string, ignoreLabels []string) m
 	return finalNodeSelector
 }
 
-func injectAffinity(affinity *corev1.Affinity, ignoreLabels []string) *corev1.Affinity {
-	labelMap := make(map[string]string)
-	for _, v := range ignoreLabels {
-		labelMap[v] = v
-	}
-	if affinity.NodeAffinity == nil {
-		return nil
-	}
-	if affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
-		return nil
-	}
-	required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
-	if required == nil {
-		return nil
-	}
-	requiredCopy := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.DeepCopy()
-	var nodeSelectorTerm []corev1.NodeSelectorTerm
-	for termIdx, term := range requiredCopy.NodeSelectorTerms {
-		var mes, mfs []corev1.NodeSelectorRequirement
-		var mesDeleteCount, mfsDeleteCount int
-		for meIdx, me := range term.MatchExpressions {
-			if labelMap[me.Key] != "" {
-				// found key, do not delete
-				continue
-			}
-			mes = append(mes, *me.DeepCopy())
-
-			required.
-				NodeSelectorTerms[termIdx].MatchExpressions = append(required.
-				NodeSelectorTerms[termIdx].MatchExpressions[:meIdx-mesDeleteCount], required.
-				NodeSelectorTerms[termIdx].MatchExpressions[meIdx-mesDeleteCount+1:]...)
-			mesDeleteCount++
-		}
-
-		for mfIdx, mf := range term.MatchFields {
-			if labelMap[mf.Key] != "" {
-				// found key, do not delete
-				continue
-			}
-
-			mfs = append(mfs, *mf.DeepCopy())
-			required.
-				NodeSelectorTerms[termIdx].MatchFields = append(required.
-				NodeSelectorTerms[termIdx].MatchFields[:mfIdx-mesDeleteCount],
-				required.NodeSelectorTerms[termIdx].MatchFields[mfIdx-mfsDeleteCount+1:]...)
-			mfsDeleteCount++
-		}
-		if len(mfs) != 0 || len(mes) != 0 {
-			nodeSelectorTerm = append(nodeSelectorTerm, corev1.NodeSelectorTerm{MatchFields: mfs, MatchExpressions: mes})
-		}
-	}
-
-	filteredTerms := make([]corev1.NodeSelectorTerm, 0)
-	for _, term := range required.NodeSelectorTerms {
-		if len(term.MatchFields) == 0 && len(term.MatchExpressions) == 0 {
-			continue
-		}
-		filteredTerms = append(filteredTerms, term)
-	}
-	if len(filteredTerms) == 0 {
-		required = nil
-	} else {
-		required.NodeSelectorTerms = filteredTerms
-	}
-	affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
-	if len(nodeSelectorTerm) == 0 {
-		return nil
-	}
-	return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
-		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: nodeSelectorTerm},
-	}}
-}
-
 func shouldSkip(pod *corev1.Pod) bool {
 	if pod.Namespace == "kube-system" {
 		return true
@@ -390,7 +565,7 @@ func getOwnerRef(pod *corev1.Pod) string {
 	return ref
 }
 
-func setUnschedulableNodes(ref string, pod *corev1.Pod) {
+func setUnschedulableNodes(ref string, pod *corev1.Pod, oldNode string) {
 	node := ""
 	if len(ref) == 0 {
 		return
@@ -401,9 +576,27 @@ func setUnschedulableNodes(ref string, pod *corev1.Pod) {
 	if len(node) > 0 {
 		klog.Infof("Unschedulable nodes %+v ref %v to cache", node, ref)
 		freezeCache.Add(node, ref)
+		return
+	}
+	if len(oldNode) > 0 {
+		klog.Infof("unschedulable-node annotation cleared, forgetting node %v ref %v", oldNode, ref)
+		freezeCache.Forget(ref, oldNode)
 	}
 }
 
+// oldPodAnnotation reads a single annotation off the admission request's
+// OldObject, used to detect when an annotation was cleared by this update.
+func oldPodAnnotation(oldObject runtime.RawExtension, key string) string {
+	if len(oldObject.Raw) == 0 {
+		return ""
+	}
+	var old corev1.Pod
+	if err := json.Unmarshal(oldObject.Raw, &old); err != nil {
+		return ""
+	}
+	return old.Annotations[key]
+}
+
 func getUnschedulableNodes(ref string, pod *corev1.Pod) []string {
 	var nodes []string
 	if len(ref) == 0 {
@@ -416,22 +609,3 @@ func getUnschedulableNodes(ref string, pod *corev1.Pod) []string {
 	klog.Infof("Not in nodes %v for %v", nodes, ref)
 	return nodes
 }
-
-func getRequestReview(r *http.Request) (*v1beta1.AdmissionReview, error) {
-	if r.Body == nil {
-		return nil, fmt.Errorf("empty body")
-	}
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
-	}
-	klog.V(5).Infof("Receive request: %+v", *r)
-	if len(body) == 0 {
-		return nil, fmt.Errorf("empty body")
-	}
-	ar := v1beta1.AdmissionReview{}
-	if deserializer.Decode(body, nil, &ar); err != nil {
-		return nil, fmt.Errorf("Can't decode body: %v", err)
-	}
-	return &ar, nil
-}
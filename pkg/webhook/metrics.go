@@ -0,0 +1,101 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "tensile_kube_webhook"
+
+var (
+	admissionRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "Total number of admission requests handled, by operation, namespace, decision and whether a patch was produced.",
+	}, []string{"operation", "namespace", "decision", "patched"})
+
+	mutationDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutation_duration_seconds",
+		Help:      "Time spent computing a pod mutation patch.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	patchSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_size_bytes",
+		Help:      "Size in bytes of the JSON patch returned for a mutated pod.",
+		Buckets:   prometheus.ExponentialBuckets(16, 2, 12),
+	})
+
+	decodeErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decode_errors_total",
+		Help:      "Total number of AdmissionReview/pod JSON decode failures.",
+	})
+
+	freezeCacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "freeze_cache_lookups_total",
+		Help:      "Total number of freezeCache lookups, by hit/miss.",
+	}, []string{"result"})
+
+	freezeCacheSize = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "freeze_cache_entries",
+		Help:      "Current number of (owner, node) entries tracked by the unschedulable-node freeze cache.",
+	}, func() float64 { return float64(freezeCache.Len()) })
+)
+
+func init() {
+	prometheus.MustRegister(
+		admissionRequestsTotal,
+		mutationDurationSeconds,
+		patchSizeBytes,
+		decodeErrorsTotal,
+		freezeCacheLookupsTotal,
+		freezeCacheSize,
+	)
+}
+
+// FreezeCacheDebugHandler serves the current unschedulable-node freeze set as
+// JSON, for operators tracing scheduling decisions without scraping metrics.
+func FreezeCacheDebugHandler() http.Handler {
+	return freezeCache.DebugHandler()
+}
+
+// MetricsHandler exposes the webhook's Prometheus metrics for mounting at /metrics.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+func recordFreezeCacheLookup(nodes []string) {
+	if len(nodes) > 0 {
+		freezeCacheLookupsTotal.WithLabelValues("hit").Inc()
+		return
+	}
+	freezeCacheLookupsTotal.WithLabelValues("miss").Inc()
+}
+
+func observeMutationDuration(operation string, start time.Time) {
+	mutationDurationSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	tensilev1alpha1 "github.com/virtual-kubelet/tensile-kube/pkg/apis/tensile/v1alpha1"
+)
+
+// mergedMutationPolicy is the effective, already-merged policy that applies
+// to a given pod; zero value means "no policy, fall back to ignoreSelectorKeys".
+type mergedMutationPolicy struct {
+	IgnoreSelectorKeys []string
+	StripAffinityKeys  []string
+	ExtraTolerations   []corev1.Toleration
+	Skip               bool
+}
+
+// PolicyStore indexes MutationPolicy objects by namespace/label selector so
+// the webhook can look up, at admission time, which policies apply to a pod.
+type PolicyStore struct {
+	mu       sync.RWMutex
+	byNS     map[string][]*tensilev1alpha1.MutationPolicy
+	nsLister corelisters.NamespaceLister
+}
+
+// NewPolicyStore builds an empty PolicyStore; call Informer to wire it to a
+// shared informer so it stays up to date as MutationPolicy objects change.
+// nsLister evaluates Spec.NamespaceSelector; pass nil if no policy in this
+// cluster sets NamespaceSelector, and any policy that does will never match.
+func NewPolicyStore(nsLister corelisters.NamespaceLister) *PolicyStore {
+	return &PolicyStore{byNS: make(map[string][]*tensilev1alpha1.MutationPolicy), nsLister: nsLister}
+}
+
+// Informer returns the cache.ResourceEventHandlerFuncs the caller should
+// register on a MutationPolicy shared informer to keep this store current.
+func (s *PolicyStore) Informer() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { s.upsert(obj) },
+		UpdateFunc: func(_, obj interface{}) { s.upsert(obj) },
+		DeleteFunc: func(obj interface{}) { s.delete(obj) },
+	}
+}
+
+func (s *PolicyStore) upsert(obj interface{}) {
+	policy, ok := obj.(*tensilev1alpha1.MutationPolicy)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.byNS[policy.Namespace]
+	for i, p := range list {
+		if p.Name == policy.Name {
+			list[i] = policy
+			s.byNS[policy.Namespace] = list
+			return
+		}
+	}
+	s.byNS[policy.Namespace] = append(list, policy)
+	klog.V(4).Infof("MutationPolicy %s/%s indexed", policy.Namespace, policy.Name)
+}
+
+func (s *PolicyStore) delete(obj interface{}) {
+	policy, ok := obj.(*tensilev1alpha1.MutationPolicy)
+	if !ok {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			policy, ok = tombstone.Obj.(*tensilev1alpha1.MutationPolicy)
+			if !ok {
+				return
+			}
+		} else {
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.byNS[policy.Namespace]
+	for i, p := range list {
+		if p.Name == policy.Name {
+			s.byNS[policy.Namespace] = append(list[:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+// PolicyFor returns the merged policy that applies to pod. Only the
+// policies tied for the highest Priority among those that match are
+// merged together; a lower-priority match is entirely overridden by any
+// higher-priority one, never blended with it. nil means no policy matched.
+func (s *PolicyStore) PolicyFor(pod *corev1.Pod) *mergedMutationPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []*tensilev1alpha1.MutationPolicy
+	matched = append(matched, s.byNS[pod.Namespace]...)
+	matched = append(matched, s.byNS[""]...)
+	if len(matched) == 0 {
+		return nil
+	}
+
+	var winners []*tensilev1alpha1.MutationPolicy
+	best := int32(-1 << 31)
+	for _, policy := range matched {
+		if !s.policyMatchesPod(policy, pod) {
+			continue
+		}
+		switch {
+		case policy.Spec.Priority > best:
+			best = policy.Spec.Priority
+			winners = winners[:0]
+			winners = append(winners, policy)
+		case policy.Spec.Priority == best:
+			winners = append(winners, policy)
+		}
+	}
+	if len(winners) == 0 {
+		return nil
+	}
+
+	merged := &mergedMutationPolicy{}
+	for _, policy := range winners {
+		merged.Skip = merged.Skip || policy.Spec.Skip
+		merged.IgnoreSelectorKeys = append(merged.IgnoreSelectorKeys, policy.Spec.IgnoreSelectorKeys...)
+		merged.StripAffinityKeys = append(merged.StripAffinityKeys, policy.Spec.StripAffinityKeys...)
+		merged.ExtraTolerations = append(merged.ExtraTolerations, policy.Spec.ExtraTolerations...)
+	}
+	return merged
+}
+
+func (s *PolicyStore) policyMatchesPod(policy *tensilev1alpha1.MutationPolicy, pod *corev1.Pod) bool {
+	if policy.Spec.Selector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(policy.Spec.Selector)
+		if err != nil {
+			klog.Errorf("MutationPolicy %s/%s has invalid selector: %v", policy.Namespace, policy.Name, err)
+			return false
+		}
+		if !sel.Matches(labelSet(pod.Labels)) {
+			return false
+		}
+	}
+	if policy.Spec.NamespaceSelector != nil {
+		if !s.namespaceMatches(policy, pod.Namespace) {
+			return false
+		}
+	}
+	return true
+}
+
+// namespaceMatches evaluates policy.Spec.NamespaceSelector against the
+// labels of the Namespace object named ns. A policy that sets
+// NamespaceSelector but has no NamespaceLister to evaluate it against, or
+// whose target namespace can't be found, never matches: failing closed here
+// is safer than silently ignoring the selector and matching everywhere.
+func (s *PolicyStore) namespaceMatches(policy *tensilev1alpha1.MutationPolicy, ns string) bool {
+	if s.nsLister == nil {
+		klog.Warningf("MutationPolicy %s/%s sets namespaceSelector but PolicyStore has no NamespaceLister; it will never match",
+			policy.Namespace, policy.Name)
+		return false
+	}
+	nsObj, err := s.nsLister.Get(ns)
+	if err != nil {
+		klog.Errorf("MutationPolicy %s/%s: get namespace %v: %v", policy.Namespace, policy.Name, ns, err)
+		return false
+	}
+	sel, err := metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+	if err != nil {
+		klog.Errorf("MutationPolicy %s/%s has invalid namespaceSelector: %v", policy.Namespace, policy.Name, err)
+		return false
+	}
+	return sel.Matches(labelSet(nsObj.Labels))
+}
+
+type labelSet map[string]string
+
+func (l labelSet) Has(key string) bool { _, ok := l[key]; return ok }
+func (l labelSet) Get(key string) string { return l[key] }
@@ -0,0 +1,278 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/virtual-kubelet/tensile-kube/pkg/util"
+)
+
+const (
+	certValidDays = 365
+	// renewBefore is how close to expiry an existing leaf certificate must
+	// be before TLSBootstrap regenerates it instead of reusing the Secret.
+	renewBefore = 30 * 24 * time.Hour
+	// TLSCertKey and TLSPrivateKeyKey mirror the corev1.SecretTypeTLS keys so
+	// the generated Secret can be mounted straight into the webhook Pod.
+	TLSCertKey       = corev1.TLSCertKey
+	TLSPrivateKeyKey = corev1.TLSPrivateKeyKey
+	// CACertKey is the Secret data key the CA certificate is stored under, so
+	// a later TLSBootstrap call can reconstruct the caBundle from the
+	// existing Secret without regenerating the CA.
+	CACertKey = "ca.crt"
+)
+
+// BootstrapOptions configures the self-signed PKI and the
+// MutatingWebhookConfiguration (and, if ValidatingWebhookName is set, the
+// ValidatingWebhookConfiguration) that TLSBootstrap creates/updates.
+type BootstrapOptions struct {
+	Namespace      string
+	ServiceName    string
+	SecretName     string
+	WebhookName    string
+	FailurePolicy  admissionregistrationv1.FailurePolicyType
+	ObjectSelector *metav1.LabelSelector
+	// ValidatingWebhookName, if non-empty, makes TLSBootstrap also
+	// create/update a ValidatingWebhookConfiguration of this name pointing at
+	// the /validate path, so the validating predicates registered via
+	// SetValidatingPredicates don't require a hand-written YAML install.
+	ValidatingWebhookName string
+}
+
+// TLSBootstrap generates (or reuses) a self-signed CA + leaf serving
+// certificate for the webhook Service, persists it to a Secret, and
+// creates/updates the MutatingWebhookConfiguration (and, when
+// opt.ValidatingWebhookName is set, the ValidatingWebhookConfiguration) so
+// the caBundle always matches the serving certificate actually in use. It
+// returns the cert pair the HTTPS server should serve.
+func TLSBootstrap(ctx context.Context, client kubernetes.Interface, opt BootstrapOptions) (*util.CertPair, error) {
+	caPEM, leafPair, err := loadOrCreateCertPair(ctx, client, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeSecret(ctx, client, opt, leafPair, caPEM); err != nil {
+		return nil, fmt.Errorf("persist serving certificate: %v", err)
+	}
+	if err := registerMutatingWebhook(ctx, client, opt, caPEM); err != nil {
+		return nil, fmt.Errorf("register MutatingWebhookConfiguration: %v", err)
+	}
+	if opt.ValidatingWebhookName != "" {
+		if err := registerValidatingWebhook(ctx, client, opt, caPEM); err != nil {
+			return nil, fmt.Errorf("register ValidatingWebhookConfiguration: %v", err)
+		}
+	}
+	return leafPair, nil
+}
+
+// loadOrCreateCertPair reuses the CA/leaf pair already stored in
+// opt.SecretName when it's present and not close to expiring, rather than
+// minting a fresh CA on every call. Without this, any pod restart or
+// additional replica behind the Service would generate its own CA, and
+// whichever replica's TLSBootstrap ran last would win the registered
+// caBundle while the others served a certificate the apiserver no longer
+// trusts. It only regenerates when the Secret is missing, unparseable, or
+// the leaf is within renewBefore of its expiry.
+func loadOrCreateCertPair(ctx context.Context, client kubernetes.Interface, opt BootstrapOptions) ([]byte, *util.CertPair, error) {
+	existing, err := client.CoreV1().Secrets(opt.Namespace).Get(ctx, opt.SecretName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, nil, fmt.Errorf("get existing Secret %v/%v: %v", opt.Namespace, opt.SecretName, err)
+	}
+	if err == nil {
+		caPEM := existing.Data[CACertKey]
+		leafPair := &util.CertPair{CertPEM: existing.Data[TLSCertKey], KeyPEM: existing.Data[TLSPrivateKeyKey]}
+		if certPairReusable(caPEM, leafPair) {
+			klog.Infof("Reusing existing serving certificate from Secret %v/%v", opt.Namespace, opt.SecretName)
+			return caPEM, leafPair, nil
+		}
+	}
+
+	dnsNames := []string{
+		opt.ServiceName,
+		fmt.Sprintf("%s.%s", opt.ServiceName, opt.Namespace),
+		fmt.Sprintf("%s.%s.svc", opt.ServiceName, opt.Namespace),
+	}
+	caCert, caKey, caPair, err := util.CreateSelfSignedCACert(opt.ServiceName+"-ca", certValidDays)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create CA: %v", err)
+	}
+	leafPair, err := util.CreateSignedCert(caCert, caKey, dnsNames, certValidDays)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create serving certificate: %v", err)
+	}
+	return caPair.CertPEM, leafPair, nil
+}
+
+// certPairReusable reports whether caPEM/leafPair form a parseable
+// certificate that isn't close enough to expiry to need renewing.
+func certPairReusable(caPEM []byte, leafPair *util.CertPair) bool {
+	if len(caPEM) == 0 || len(leafPair.CertPEM) == 0 || len(leafPair.KeyPEM) == 0 {
+		return false
+	}
+	leaf, err := util.ParseCertPEM(leafPair.CertPEM)
+	if err != nil {
+		klog.Warningf("Existing serving certificate is unparseable, regenerating: %v", err)
+		return false
+	}
+	if time.Until(leaf.NotAfter) < renewBefore {
+		klog.Infof("Existing serving certificate expires %v, regenerating", leaf.NotAfter)
+		return false
+	}
+	return true
+}
+
+func writeSecret(ctx context.Context, client kubernetes.Interface, opt BootstrapOptions, pair *util.CertPair, caPEM []byte) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opt.SecretName,
+			Namespace: opt.Namespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			TLSCertKey:       pair.CertPEM,
+			TLSPrivateKeyKey: pair.KeyPEM,
+			CACertKey:        caPEM,
+		},
+	}
+	_, err := client.CoreV1().Secrets(opt.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = client.CoreV1().Secrets(opt.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+func registerMutatingWebhook(ctx context.Context, client kubernetes.Interface, opt BootstrapOptions, caBundle []byte) error {
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	path := "/mutate"
+	failurePolicy := opt.FailurePolicy
+	if failurePolicy == "" {
+		failurePolicy = admissionregistrationv1.Ignore
+	}
+	cfg := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: opt.WebhookName,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name: opt.WebhookName,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Namespace: opt.Namespace,
+						Name:      opt.ServiceName,
+						Path:      &path,
+					},
+					CABundle: caBundle,
+				},
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{
+							admissionregistrationv1.Create, admissionregistrationv1.Update,
+						},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods"},
+						},
+					},
+				},
+				FailurePolicy:           &failurePolicy,
+				ObjectSelector:          opt.ObjectSelector,
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+		},
+	}
+
+	existing, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, opt.WebhookName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(ctx, cfg, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cfg.ResourceVersion = existing.ResourceVersion
+	klog.Infof("Updating MutatingWebhookConfiguration %v with refreshed caBundle", opt.WebhookName)
+	_, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{})
+	return err
+}
+
+func registerValidatingWebhook(ctx context.Context, client kubernetes.Interface, opt BootstrapOptions, caBundle []byte) error {
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	path := "/validate"
+	failurePolicy := opt.FailurePolicy
+	if failurePolicy == "" {
+		failurePolicy = admissionregistrationv1.Ignore
+	}
+	cfg := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: opt.ValidatingWebhookName,
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{
+				Name: opt.ValidatingWebhookName,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Namespace: opt.Namespace,
+						Name:      opt.ServiceName,
+						Path:      &path,
+					},
+					CABundle: caBundle,
+				},
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{
+							admissionregistrationv1.Create, admissionregistrationv1.Update,
+						},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods"},
+						},
+					},
+				},
+				FailurePolicy:           &failurePolicy,
+				ObjectSelector:          opt.ObjectSelector,
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+		},
+	}
+
+	existing, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, opt.ValidatingWebhookName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Create(ctx, cfg, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cfg.ResourceVersion = existing.ResourceVersion
+	klog.Infof("Updating ValidatingWebhookConfiguration %v with refreshed caBundle", opt.ValidatingWebhookName)
+	_, err = client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright ©2020. The virtual-kubelet authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/virtual-kubelet/tensile-kube/pkg/util"
+)
+
+// Predicate is a single, independently registerable validation rule run
+// against a candidate virtual pod. It returns a non-empty reason when the
+// pod should be rejected.
+type Predicate func(whsvr *webhookServer, pod *corev1.Pod) (reason string, err error)
+
+// predicateRegistry holds every known predicate by name; webhookServer.validate
+// only runs the subset enabled via SetValidatingPredicates, so new checks can
+// be added here without touching the HTTP layer or existing deployments.
+var predicateRegistry = map[string]Predicate{
+	"affinity-matches-node": affinityMatchesSomeNode,
+	"pvc-node-known":        pvcSelectedNodeKnown,
+	"max-tolerations":       withinMaxTolerations,
+}
+
+// RegisterPredicate adds (or overrides) a named validating predicate.
+func RegisterPredicate(name string, p Predicate) {
+	predicateRegistry[name] = p
+}
+
+// validate runs the enabled predicates against the candidate pod and denies
+// admission if any of them reject it.
+func (whsvr *webhookServer) validate(req *admissionRequest) *admissionResponse {
+	if req.Kind.Kind != "Pod" {
+		return &admissionResponse{Allowed: true}
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		klog.Errorf("Could not unmarshal raw object %v err: %v", req, err)
+		decodeErrorsTotal.Inc()
+		return &admissionResponse{
+			Result: &metav1.Status{Message: err.Error()},
+		}
+	}
+	if shouldSkip(&pod) {
+		return &admissionResponse{Allowed: true}
+	}
+
+	for _, name := range whsvr.validatePredicates {
+		p, ok := predicateRegistry[name]
+		if !ok {
+			klog.Warningf("Unknown validating predicate %q, skipping", name)
+			continue
+		}
+		reason, err := p(whsvr, &pod)
+		if err != nil {
+			klog.Errorf("Predicate %q errored for pod %v/%v: %v", name, pod.Namespace, pod.Name, err)
+			continue
+		}
+		if reason != "" {
+			return &admissionResponse{
+				Allowed: false,
+				Result:  &metav1.Status{Message: reason},
+			}
+		}
+	}
+	return &admissionResponse{Allowed: true}
+}
+
+// affinityMatchesSomeNode rejects pods whose sub-cluster node affinity would
+// match zero real nodes in every registered sub-cluster. By the time a
+// ValidatingWebhookConfiguration callback runs, the apiserver has already
+// applied the mutating patch, so pod.Spec.Affinity only holds the "kept"
+// half (the part left on the real pod); the half that actually needs to
+// match a sub-cluster node lives in the util.SelectorKey annotation that
+// mutate() wrote, so that's what's read here instead.
+func affinityMatchesSomeNode(whsvr *webhookServer, pod *corev1.Pod) (string, error) {
+	if len(whsvr.clusterNodeListers) == 0 {
+		return "", nil
+	}
+	raw, ok := pod.Annotations[util.SelectorKey]
+	if !ok {
+		return "", nil
+	}
+	var cns util.ClustersNodeSelection
+	if err := json.Unmarshal([]byte(raw), &cns); err != nil {
+		return "", fmt.Errorf("unmarshal %v annotation: %v", util.SelectorKey, err)
+	}
+	remaining := cns.Affinity
+	if remaining == nil {
+		return "", nil
+	}
+	for _, lister := range whsvr.clusterNodeListers {
+		nodes, err := lister.List(labels.Everything())
+		if err != nil {
+			return "", err
+		}
+		for _, node := range nodes {
+			if util.NodeMatchesAffinity(node, remaining) {
+				return "", nil
+			}
+		}
+	}
+	return "pod affinity matches zero nodes in any registered sub-cluster", nil
+}
+
+// pvcSelectedNodeKnown rejects pods requesting PVCs whose SelectedNodeKey
+// annotation points at a node not in any known sub-cluster.
+func pvcSelectedNodeKnown(whsvr *webhookServer, pod *corev1.Pod) (string, error) {
+	if whsvr.pvcLister == nil || len(whsvr.clusterNodeListers) == 0 {
+		return "", nil
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		pvc, err := whsvr.pvcLister.PersistentVolumeClaims(pod.Namespace).Get(volume.PersistentVolumeClaim.ClaimName)
+		if err != nil {
+			continue
+		}
+		nodeName := pvc.Annotations[util.SelectedNodeKey]
+		if len(nodeName) == 0 {
+			continue
+		}
+		known := false
+		for _, lister := range whsvr.clusterNodeListers {
+			if _, err := lister.Get(nodeName); err == nil {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Sprintf("PVC %v selected node %v is not in any known cluster", volume.PersistentVolumeClaim.ClaimName, nodeName), nil
+		}
+	}
+	return "", nil
+}
+
+// withinMaxTolerations rejects pods whose toleration count would exceed the
+// configured limit; disabled when maxTolerations is zero.
+func withinMaxTolerations(whsvr *webhookServer, pod *corev1.Pod) (string, error) {
+	if whsvr.maxTolerations <= 0 {
+		return "", nil
+	}
+	if len(pod.Spec.Tolerations) > whsvr.maxTolerations {
+		return fmt.Sprintf("pod has %d tolerations, exceeding the max of %d", len(pod.Spec.Tolerations), whsvr.maxTolerations), nil
+	}
+	return "", nil
+}